@@ -0,0 +1,211 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"fmt"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// FlatPackage is the JSON-serializable package shape emitted by the
+// gopackages Bazel aspect, keyed by the same fields as
+// golang.org/x/tools/go/packages.Package so a PackageRegistry can hand its
+// contents straight to a packages.Driver response.
+type FlatPackage struct {
+	ID       string
+	PkgPath  string
+	Standard bool
+
+	GoFiles         []string
+	CompiledGoFiles []string
+	CFiles          []string
+	CgoFiles        []string
+	EmbedFiles      []string
+	OtherFiles      []string
+	ExportFile      string
+
+	Imports map[string]string
+
+	// Overlay holds the unsaved editor buffer contents (from
+	// DriverRequest.Overlay) for any of this package's files, keyed by file
+	// path. Populated by applyOverlay.
+	Overlay map[string][]byte
+
+	// Variants holds the other FlatPackages that were merged into this one
+	// under the same PkgPath by merge, each still addressable under its own
+	// synthetic "<pkgpath>#<variant>" ID.
+	Variants []*FlatPackage
+}
+
+// IsStdlib reports whether pkg was produced from the stdlib aspect rather
+// than a workspace target.
+func (pkg *FlatPackage) IsStdlib() bool {
+	return pkg.Standard
+}
+
+// buildContextFromEnv derives a go/build.Context from the GOOS, GOARCH and
+// tags keys of env (the shape DriverRequest.BuildFlags is parsed into),
+// falling back to the running toolchain's defaults for anything unset.
+func buildContextFromEnv(env map[string]string) build.Context {
+	ctx := build.Default
+	if goos := env["GOOS"]; goos != "" {
+		ctx.GOOS = goos
+	}
+	if goarch := env["GOARCH"]; goarch != "" {
+		ctx.GOARCH = goarch
+	}
+	if tags := env["tags"]; tags != "" {
+		ctx.BuildTags = strings.Split(tags, ",")
+	}
+	return ctx
+}
+
+// filterByBuildContext returns the subset of files that ctx.MatchFile
+// accepts for the given build context. A file that can't be read (e.g. a
+// generated source that hasn't been written yet) is kept rather than
+// dropped, matching the fail-open behavior digestPackage uses for the same
+// situation.
+func filterByBuildContext(ctx build.Context, files []string) []string {
+	kept := files[:0:0]
+	for _, f := range files {
+		ok, err := ctx.MatchFile(filepath.Dir(f), filepath.Base(f))
+		if err != nil || ok {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// FilterFilesForBuildTags trims pkg's file lists in place to the files that
+// apply under the build context described by env (GOOS/GOARCH/tags, as
+// parsed from DriverRequest.BuildFlags). Called on a PackageView's cloned
+// packages, never on the canonical registry's.
+func (pkg *FlatPackage) FilterFilesForBuildTags(env map[string]string) {
+	ctx := buildContextFromEnv(env)
+	pkg.GoFiles = filterByBuildContext(ctx, pkg.GoFiles)
+	pkg.CompiledGoFiles = filterByBuildContext(ctx, pkg.CompiledGoFiles)
+	pkg.CFiles = filterByBuildContext(ctx, pkg.CFiles)
+	pkg.CgoFiles = filterByBuildContext(ctx, pkg.CgoFiles)
+	pkg.OtherFiles = filterByBuildContext(ctx, pkg.OtherFiles)
+}
+
+// ResolvePaths rewrites every file-list entry and ExportFile through prf,
+// turning the repo-relative paths the Bazel aspect emits into the absolute
+// paths gopls and golangci-lint expect.
+func (pkg *FlatPackage) ResolvePaths(prf PathResolverFunc) {
+	resolveAll := func(files []string) []string {
+		for i, f := range files {
+			files[i] = prf(f)
+		}
+		return files
+	}
+	pkg.GoFiles = resolveAll(pkg.GoFiles)
+	pkg.CompiledGoFiles = resolveAll(pkg.CompiledGoFiles)
+	pkg.CFiles = resolveAll(pkg.CFiles)
+	pkg.CgoFiles = resolveAll(pkg.CgoFiles)
+	pkg.EmbedFiles = resolveAll(pkg.EmbedFiles)
+	pkg.OtherFiles = resolveAll(pkg.OtherFiles)
+	if pkg.ExportFile != "" {
+		pkg.ExportFile = prf(pkg.ExportFile)
+	}
+}
+
+// ResolveImports fills in the package ID for any import the Bazel aspect
+// left unresolved (stdlib imports, which aren't tracked as deps of the
+// target that produced this package) by parsing pkg's Go files for their
+// import paths and asking resolve for each one missing from pkg.Imports.
+// An import resolve can't place (e.g. one guarded by a build tag this
+// package's GoFiles don't include) is left out rather than erroring.
+func (pkg *FlatPackage) ResolveImports(resolve func(importPath string) string) error {
+	fset := token.NewFileSet()
+	for _, f := range pkg.GoFiles {
+		file, err := parser.ParseFile(fset, f, nil, parser.ImportsOnly)
+		if err != nil {
+			return fmt.Errorf("parsing imports of %s: %w", f, err)
+		}
+		for _, imp := range file.Imports {
+			path, err := strconv.Unquote(imp.Path.Value)
+			if err != nil {
+				continue
+			}
+			if _, ok := pkg.Imports[path]; ok {
+				continue
+			}
+			if id := resolve(path); id != "" {
+				if pkg.Imports == nil {
+					pkg.Imports = map[string]string{}
+				}
+				pkg.Imports[path] = id
+			}
+		}
+	}
+	return nil
+}
+
+// MoveTestFiles splits pkg's external test files (those declaring `package
+// foo_test`) out of GoFiles/CompiledGoFiles into a synthetic FlatPackage
+// addressable as pkg.ID + "_xtest", mirroring how go/packages represents the
+// external test package as a separate package from the one under test. It
+// returns nil if pkg has no external test files.
+func (pkg *FlatPackage) MoveTestFiles() *FlatPackage {
+	fset := token.NewFileSet()
+	var xtestGo, xtestCompiled, keptGo, keptCompiled []string
+
+	isExternalTest := func(f string) bool {
+		if !strings.HasSuffix(f, "_test.go") {
+			return false
+		}
+		file, err := parser.ParseFile(fset, f, nil, parser.PackageClauseOnly)
+		if err != nil {
+			return false
+		}
+		return strings.HasSuffix(file.Name.Name, "_test")
+	}
+
+	for _, f := range pkg.GoFiles {
+		if isExternalTest(f) {
+			xtestGo = append(xtestGo, f)
+		} else {
+			keptGo = append(keptGo, f)
+		}
+	}
+	for _, f := range pkg.CompiledGoFiles {
+		if isExternalTest(f) {
+			xtestCompiled = append(xtestCompiled, f)
+		} else {
+			keptCompiled = append(keptCompiled, f)
+		}
+	}
+
+	if len(xtestGo) == 0 && len(xtestCompiled) == 0 {
+		return nil
+	}
+
+	pkg.GoFiles = keptGo
+	pkg.CompiledGoFiles = keptCompiled
+
+	return &FlatPackage{
+		ID:              pkg.ID + "_xtest",
+		PkgPath:         pkg.PkgPath,
+		GoFiles:         xtestGo,
+		CompiledGoFiles: xtestCompiled,
+		Imports:         map[string]string{pkg.PkgPath: pkg.ID},
+	}
+}
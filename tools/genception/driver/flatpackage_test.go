@@ -0,0 +1,150 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFilterFilesForBuildTags(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	common := write("common.go", "package p\n")
+	linuxOnly := write("thing_linux.go", "package p\n")
+	darwinOnly := write("thing_darwin.go", "package p\n")
+	tagged := write("extra.go", "//go:build integration\n\npackage p\n")
+
+	pkg := &FlatPackage{
+		GoFiles: []string{common, linuxOnly, darwinOnly, tagged},
+	}
+	pkg.FilterFilesForBuildTags(map[string]string{"GOOS": "linux", "GOARCH": "amd64"})
+
+	want := map[string]bool{common: true, linuxOnly: true}
+	if len(pkg.GoFiles) != len(want) {
+		t.Fatalf("GoFiles = %v, want exactly %v", pkg.GoFiles, want)
+	}
+	for _, f := range pkg.GoFiles {
+		if !want[f] {
+			t.Errorf("unexpected file kept for linux/amd64: %s", f)
+		}
+	}
+
+	pkg2 := &FlatPackage{
+		GoFiles: []string{common, linuxOnly, darwinOnly, tagged},
+	}
+	pkg2.FilterFilesForBuildTags(map[string]string{"GOOS": "linux", "GOARCH": "amd64", "tags": "integration"})
+	foundTagged := false
+	for _, f := range pkg2.GoFiles {
+		if f == tagged {
+			foundTagged = true
+		}
+	}
+	if !foundTagged {
+		t.Errorf("GoFiles = %v, want tagged file kept when tags=integration", pkg2.GoFiles)
+	}
+}
+
+func TestResolvePathsRewritesAllFileLists(t *testing.T) {
+	pkg := &FlatPackage{
+		GoFiles:    []string{"a.go"},
+		CFiles:     []string{"a.c"},
+		ExportFile: "a.x",
+	}
+	pkg.ResolvePaths(func(p string) string { return "/root/" + p })
+
+	if pkg.GoFiles[0] != "/root/a.go" || pkg.CFiles[0] != "/root/a.c" || pkg.ExportFile != "/root/a.x" {
+		t.Errorf("ResolvePaths did not rewrite all fields: %+v", pkg)
+	}
+}
+
+func TestResolveImportsAddsMissingStdlibImport(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "a.go")
+	if err := os.WriteFile(p, []byte("package p\n\nimport \"fmt\"\n\nvar _ = fmt.Sprintf\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	pkg := &FlatPackage{GoFiles: []string{p}, Imports: map[string]string{}}
+
+	err := pkg.ResolveImports(func(importPath string) string {
+		if importPath == "fmt" {
+			return "fmt"
+		}
+		return ""
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg.Imports["fmt"] != "fmt" {
+		t.Errorf("Imports = %v, want fmt resolved", pkg.Imports)
+	}
+}
+
+func TestMoveTestFilesSplitsExternalTestPackage(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	internal := write("a.go", "package p\n")
+	internalTest := write("a_test.go", "package p\n")
+	external := write("a_x_test.go", "package p_test\n")
+
+	pkg := &FlatPackage{
+		ID:      "//a:go_default_library",
+		PkgPath: "a",
+		GoFiles: []string{internal, internalTest, external},
+	}
+
+	xtest := pkg.MoveTestFiles()
+	if xtest == nil {
+		t.Fatal("MoveTestFiles returned nil, want a split xtest package")
+	}
+	if xtest.ID != "//a:go_default_library_xtest" {
+		t.Errorf("xtest.ID = %q, want suffixed with _xtest", xtest.ID)
+	}
+	if len(xtest.GoFiles) != 1 || xtest.GoFiles[0] != external {
+		t.Errorf("xtest.GoFiles = %v, want [%s]", xtest.GoFiles, external)
+	}
+	if len(pkg.GoFiles) != 2 {
+		t.Errorf("pkg.GoFiles = %v, want external test file removed", pkg.GoFiles)
+	}
+	if xtest.Imports[pkg.PkgPath] != pkg.ID {
+		t.Errorf("xtest.Imports = %v, want import back on the package under test", xtest.Imports)
+	}
+}
+
+func TestMoveTestFilesReturnsNilWithoutExternalTests(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "a_test.go")
+	if err := os.WriteFile(p, []byte("package p\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	pkg := &FlatPackage{GoFiles: []string{p}}
+	if xtest := pkg.MoveTestFiles(); xtest != nil {
+		t.Errorf("MoveTestFiles() = %v, want nil when no external test files", xtest)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestVariantTag(t *testing.T) {
+	cases := []struct {
+		id   string
+		want string
+	}{
+		{"//proto/engine/v1:go_proto", "proto"},
+		{"//proto/engine/v1:go_default_library", "library"},
+		{"//proto/engine/v1:go_other_rule", "go_other_rule"},
+		{"no-colon", "no-colon"},
+	}
+	for _, c := range cases {
+		if got := variantTag(&FlatPackage{ID: c.id}); got != c.want {
+			t.Errorf("variantTag(%q) = %q, want %q", c.id, got, c.want)
+		}
+	}
+}
+
+func TestMergeUnionsFileListsAndRecordsVariant(t *testing.T) {
+	existing := &FlatPackage{
+		ID:              "//proto/engine/v1:go_default_library",
+		PkgPath:         "proto/engine/v1",
+		GoFiles:         []string{"a.go"},
+		CompiledGoFiles: []string{"a.go"},
+		Imports:         map[string]string{"fmt": "fmt"},
+	}
+	incoming := &FlatPackage{
+		ID:              "//proto/engine/v1:go_proto",
+		PkgPath:         "proto/engine/v1",
+		GoFiles:         []string{"a.pb.go"},
+		CompiledGoFiles: []string{"a.pb.go"},
+		Imports:         map[string]string{"context": "context"},
+	}
+
+	variant := merge(existing, incoming)
+
+	wantGoFiles := []string{"a.go", "a.pb.go"}
+	sort.Strings(existing.GoFiles)
+	if !reflect.DeepEqual(existing.GoFiles, wantGoFiles) {
+		t.Errorf("GoFiles = %v, want %v", existing.GoFiles, wantGoFiles)
+	}
+	if existing.Imports["fmt"] != "fmt" || existing.Imports["context"] != "context" {
+		t.Errorf("Imports = %v, missing merged entries", existing.Imports)
+	}
+
+	wantID := "proto/engine/v1#proto"
+	if variant.ID != wantID {
+		t.Errorf("variant.ID = %q, want %q", variant.ID, wantID)
+	}
+	if len(existing.Variants) != 1 || existing.Variants[0] != variant {
+		t.Errorf("existing.Variants = %v, want [variant]", existing.Variants)
+	}
+}
+
+func TestMergePrefersNonStdlibOnImportConflict(t *testing.T) {
+	existing := &FlatPackage{
+		PkgPath: "proto/engine/v1",
+		Imports: map[string]string{"errors": stdlibPrefix + "errors"},
+	}
+	incoming := &FlatPackage{
+		PkgPath: "proto/engine/v1",
+		Imports: map[string]string{"errors": "//third_party:errors"},
+	}
+
+	merge(existing, incoming)
+
+	if got := existing.Imports["errors"]; got != "//third_party:errors" {
+		t.Errorf("Imports[errors] = %q, want non-stdlib id to win", got)
+	}
+}
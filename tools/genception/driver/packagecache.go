@@ -0,0 +1,285 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+)
+
+// cacheDirName is the subdirectory created under XDG_CACHE_HOME (or
+// os.UserCacheDir() when unset) to hold indexed package-load blobs.
+const cacheDirName = "gopackagesdriver"
+
+// cacheEntry is a single indexed blob on disk: the packages that were
+// loaded for a (workspace, aspect, target-pattern, configuration) tuple,
+// along with the digests and action-graph hashes they were computed from.
+type cacheEntry struct {
+	StdlibRoot   string            `json:"stdlib_root"`
+	ActionHashes map[string]string `json:"action_hashes"`
+	Digests      map[string]string `json:"digests"`
+	Packages     []*FlatPackage    `json:"packages"`
+}
+
+// PackageCache memoizes the FlatPackage set produced by the Bazel aspect so
+// that repeated driver invocations against an unchanged workspace don't pay
+// the cost of re-running the aspect over the whole target pattern.
+type PackageCache struct {
+	dir string
+}
+
+// NewPackageCache returns a PackageCache rooted at
+// $XDG_CACHE_HOME/gopackagesdriver/ (or the platform cache dir when
+// XDG_CACHE_HOME is unset).
+func NewPackageCache() (*PackageCache, error) {
+	base := os.Getenv("XDG_CACHE_HOME")
+	if base == "" {
+		var err error
+		base, err = os.UserCacheDir()
+		if err != nil {
+			return nil, fmt.Errorf("resolving user cache dir: %w", err)
+		}
+	}
+	dir := filepath.Join(base, cacheDirName)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating cache dir %s: %w", dir, err)
+	}
+	return &PackageCache{dir: dir}, nil
+}
+
+// key computes the cache file name for a (workspace, aspect, patterns,
+// configHash) tuple. The patterns are sorted so that equivalent queries in a
+// different order share a cache entry.
+func (c *PackageCache) key(workspace, aspect string, patterns []string, configHash string) string {
+	sorted := append([]string(nil), patterns...)
+	sort.Strings(sorted)
+
+	h := sha256.New()
+	fmt.Fprintln(h, workspace)
+	fmt.Fprintln(h, aspect)
+	fmt.Fprintln(h, configHash)
+	for _, p := range sorted {
+		fmt.Fprintln(h, p)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *PackageCache) path(workspace, aspect string, patterns []string, configHash string) string {
+	return filepath.Join(c.dir, c.key(workspace, aspect, patterns, configHash)+".json")
+}
+
+// digestPackage computes a stable digest of a FlatPackage's sources,
+// imports, and export file so that a cache entry can be invalidated as soon
+// as any of them change, independent of the action-graph hash lookup.
+func digestPackage(pkg *FlatPackage) (string, error) {
+	h := sha256.New()
+	fmt.Fprintln(h, pkg.ID)
+
+	files := append([]string(nil), pkg.GoFiles...)
+	files = append(files, pkg.CompiledGoFiles...)
+	sort.Strings(files)
+	for _, f := range files {
+		fmt.Fprintln(h, f)
+		contents, err := os.ReadFile(f)
+		if err != nil {
+			// Source files generated by the aspect may not exist yet on a
+			// cold checkout; fall back to the path alone.
+			continue
+		}
+		h.Write(contents)
+	}
+
+	imports := make([]string, 0, len(pkg.Imports))
+	for k, v := range pkg.Imports {
+		imports = append(imports, k+"="+v)
+	}
+	sort.Strings(imports)
+	for _, imp := range imports {
+		fmt.Fprintln(h, imp)
+	}
+
+	if pkg.ExportFile != "" {
+		fmt.Fprintln(h, pkg.ExportFile)
+		if fi, err := os.Stat(pkg.ExportFile); err == nil {
+			fmt.Fprintln(h, fi.ModTime().UnixNano())
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// actionGraphHashes runs `bazel cquery --output=jsonproto` over patterns and
+// returns a map of target label to the hash of its action graph, so that
+// Load can tell whether a previously cached target needs to be re-aspected.
+func actionGraphHashes(workspace string, patterns []string) (map[string]string, error) {
+	args := append([]string{"cquery", "--output=jsonproto"}, patterns...)
+	cmd := exec.Command("bazel", args...)
+	cmd.Dir = workspace
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("bazel cquery: %w: %s", err, out.String())
+	}
+
+	var parsed struct {
+		Results []struct {
+			Target struct {
+				Label string `json:"label"`
+			} `json:"target"`
+			ActionGraphHash string `json:"actionGraphHash"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &parsed); err != nil {
+		return nil, fmt.Errorf("parsing bazel cquery output: %w", err)
+	}
+
+	hashes := make(map[string]string, len(parsed.Results))
+	for _, r := range parsed.Results {
+		hashes[r.Target.Label] = r.ActionGraphHash
+	}
+	return hashes, nil
+}
+
+// staleLabels returns the labels present in current or recorded whose hash
+// differs between the two (including a label only present on one side),
+// i.e. the Bazel targets that must be re-aspected.
+func staleLabels(current, recorded map[string]string) []string {
+	var stale []string
+	seen := make(map[string]struct{}, len(current)+len(recorded))
+	for label := range current {
+		seen[label] = struct{}{}
+	}
+	for label := range recorded {
+		seen[label] = struct{}{}
+	}
+	for label := range seen {
+		if current[label] != recorded[label] {
+			stale = append(stale, label)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+// Load returns the cached packages for the given tuple along with the set of
+// Bazel labels whose action-graph hash no longer matches the cached one
+// (and therefore must be re-aspected by the caller). A cache miss returns
+// all patterns as stale.
+func (c *PackageCache) Load(workspace, aspect string, patterns []string, configHash, stdlibRoot string) (*PackageRegistry, []string, error) {
+	raw, err := os.ReadFile(c.path(workspace, aspect, patterns, configHash))
+	if os.IsNotExist(err) {
+		return nil, patterns, nil
+	}
+	if err != nil {
+		return nil, patterns, err
+	}
+
+	var entry cacheEntry
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		return nil, patterns, err
+	}
+
+	// The stdlib SDK root is part of the cache key logically, but it's
+	// cheaper to store it in the entry and compare than to fold it into the
+	// file name, since it changes for everyone in a workspace at once.
+	if entry.StdlibRoot != stdlibRoot {
+		return nil, patterns, nil
+	}
+
+	// Check content digests before paying for a bazel invocation: a source
+	// or export file can change content without changing the action-graph
+	// hash (e.g. a gofmt-only edit that cquery happens to not reflect yet),
+	// so this check runs independent of and before the hash comparison
+	// below.
+	for _, pkg := range entry.Packages {
+		digest, err := digestPackage(pkg)
+		if err != nil {
+			return nil, patterns, err
+		}
+		if digest != entry.Digests[pkg.ID] {
+			return nil, patterns, nil
+		}
+	}
+
+	currentHashes, err := actionGraphHashes(workspace, patterns)
+	if err != nil {
+		return nil, patterns, err
+	}
+
+	// currentHashes and entry.ActionHashes are both keyed by the resolved
+	// Bazel label (see actionGraphHashes), not by the input patterns: a
+	// single pattern like "//..." expands to many labels, so there's no 1:1
+	// pattern-to-hash correspondence to compare against.
+	stale := staleLabels(currentHashes, entry.ActionHashes)
+
+	// The cached packages were already canonicalized when they were first
+	// added, so each is restored under its own ID instead of going through
+	// Add, which would rewrite variant and xtest IDs to their PkgPath and let
+	// them overwrite the canonical package.
+	pr := NewPackageRegistry()
+	for _, pkg := range entry.Packages {
+		pr.packages[pkg.ID] = pkg
+		if pkg.IsStdlib() {
+			pr.stdlib[pkg.PkgPath] = pkg.ID
+		}
+		for _, importID := range pkg.Imports {
+			pr.importedBy[importID] = append(pr.importedBy[importID], pkg.ID)
+		}
+	}
+	return pr, stale, nil
+}
+
+// Save writes the current package set for the (workspace, aspect, patterns,
+// configHash) tuple to disk, recording the action-graph hashes it was
+// computed from so a later Load can detect staleness without re-running the
+// aspect.
+func (c *PackageCache) Save(workspace, aspect string, patterns []string, configHash, stdlibRoot string, pr *PackageRegistry) error {
+	hashes, err := actionGraphHashes(workspace, patterns)
+	if err != nil {
+		return err
+	}
+
+	pkgs := make([]*FlatPackage, 0, len(pr.packages))
+	digests := make(map[string]string, len(pr.packages))
+	for _, pkg := range pr.packages {
+		pkgs = append(pkgs, pkg)
+		digest, err := digestPackage(pkg)
+		if err != nil {
+			return err
+		}
+		digests[pkg.ID] = digest
+	}
+
+	entry := cacheEntry{
+		StdlibRoot:   stdlibRoot,
+		ActionHashes: hashes,
+		Digests:      digests,
+		Packages:     pkgs,
+	}
+
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.path(workspace, aspect, patterns, configHash), raw, 0o644)
+}
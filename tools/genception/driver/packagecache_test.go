@@ -0,0 +1,98 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestStaleLabels(t *testing.T) {
+	cases := []struct {
+		name      string
+		current   map[string]string
+		recorded  map[string]string
+		wantStale []string
+	}{
+		{
+			name:      "unchanged",
+			current:   map[string]string{"//foo:go_default_library": "h1"},
+			recorded:  map[string]string{"//foo:go_default_library": "h1"},
+			wantStale: nil,
+		},
+		{
+			name:      "changed hash",
+			current:   map[string]string{"//foo:go_default_library": "h2"},
+			recorded:  map[string]string{"//foo:go_default_library": "h1"},
+			wantStale: []string{"//foo:go_default_library"},
+		},
+		{
+			name:      "new label not in cache",
+			current:   map[string]string{"//foo:go_default_library": "h1", "//bar:go_default_library": "h1"},
+			recorded:  map[string]string{"//foo:go_default_library": "h1"},
+			wantStale: []string{"//bar:go_default_library"},
+		},
+		{
+			name:      "label removed from workspace",
+			current:   map[string]string{"//foo:go_default_library": "h1"},
+			recorded:  map[string]string{"//foo:go_default_library": "h1", "//bar:go_default_library": "h1"},
+			wantStale: []string{"//bar:go_default_library"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := staleLabels(c.current, c.recorded)
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, c.wantStale) {
+				t.Errorf("staleLabels(%v, %v) = %v, want %v", c.current, c.recorded, got, c.wantStale)
+			}
+		})
+	}
+}
+
+func TestDigestPackageChangesWithContent(t *testing.T) {
+	dir := t.TempDir()
+	path := dir + "/a.go"
+	if err := os.WriteFile(path, []byte("package p\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	pkg := &FlatPackage{ID: "//foo:go_default_library", GoFiles: []string{path}}
+
+	d1, err := digestPackage(pkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d2, err := digestPackage(pkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d1 != d2 {
+		t.Errorf("digestPackage is not stable across identical calls: %s != %s", d1, d2)
+	}
+
+	if err := os.WriteFile(path, []byte("package p\n\nvar X = 1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	d3, err := digestPackage(pkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d3 == d1 {
+		t.Errorf("digestPackage did not change after source content changed")
+	}
+}
@@ -16,18 +16,37 @@ package driver
 
 import (
 	"fmt"
+	"sort"
 	"strings"
+
+	"golang.org/x/tools/go/packages"
 )
 
+// defaultReverseDepDepth bounds how many levels of importers walkUp
+// traverses by default when a request asks for reverse dependencies.
+const defaultReverseDepDepth = 1
+
 type PackageRegistry struct {
 	packages map[string]*FlatPackage
 	stdlib   map[string]string
+
+	// importedBy is the reverse of every package's Imports map: for
+	// package ID p, importedBy[p] holds the IDs of the packages that
+	// import p.
+	importedBy map[string][]string
+
+	// ReverseDepDepth bounds how many levels of importers walkUp will
+	// traverse when Query or Match is asked for reverse dependencies.
+	// Defaults to defaultReverseDepDepth.
+	ReverseDepDepth int
 }
 
 func NewPackageRegistry(pkgs ...*FlatPackage) *PackageRegistry {
 	pr := &PackageRegistry{
-		packages: map[string]*FlatPackage{},
-		stdlib:   map[string]string{},
+		packages:        map[string]*FlatPackage{},
+		stdlib:          map[string]string{},
+		importedBy:      map[string][]string{},
+		ReverseDepDepth: defaultReverseDepDepth,
 	}
 	pr.Add(pkgs...)
 	return pr
@@ -53,35 +72,117 @@ func rewritePackage(pkg *FlatPackage) {
 	}
 }
 
-// returns true if a is a superset of b
-func isSuperset(a, b []string) bool {
-	if len(a) < len(b) {
-		return false
+// unionStrings returns the sorted, deduplicated union of a and b.
+func unionStrings(a, b []string) []string {
+	set := make(map[string]struct{}, len(a)+len(b))
+	for _, s := range a {
+		set[s] = struct{}{}
 	}
-	bi := 0
-	for i := range a {
-		if a[i] == b[bi] {
-			bi++
-			if bi == len(b) {
-				return true
-			}
+	for _, s := range b {
+		set[s] = struct{}{}
+	}
+	out := make([]string, 0, len(set))
+	for s := range set {
+		out = append(out, s)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// isStdlibID reports whether id is a raw (pre-canonicalization) stdlib
+// package ID, as opposed to an ordinary bazel label.
+func isStdlibID(id string) bool {
+	return strings.HasPrefix(id, stdlibPrefix)
+}
+
+// variantTag derives a short, stable suffix for a package's synthetic
+// variant ID from the name of the rule that produced it, e.g.
+// "//proto/engine/v1:go_proto" becomes "proto" and
+// "//proto/engine/v1:go_default_library" becomes "library".
+func variantTag(pkg *FlatPackage) string {
+	_, rule, ok := strings.Cut(pkg.ID, ":")
+	if !ok || rule == "" {
+		return pkg.ID
+	}
+	switch {
+	case strings.Contains(rule, "proto"):
+		return "proto"
+	case strings.Contains(rule, "library"):
+		return "library"
+	default:
+		return rule
+	}
+}
+
+// merge unions the file lists and import maps of existing and incoming, two
+// FlatPackages generated for the same PkgPath by different rules_go targets
+// (e.g. a go_proto wrapper and its go_default_library). incoming is given a
+// synthetic "<pkgpath>#<variant>" ID, recorded on existing.Variants, and
+// returned so the caller can register it under that ID too.
+func merge(existing, incoming *FlatPackage) *FlatPackage {
+	existing.GoFiles = unionStrings(existing.GoFiles, incoming.GoFiles)
+	existing.CompiledGoFiles = unionStrings(existing.CompiledGoFiles, incoming.CompiledGoFiles)
+	existing.CFiles = unionStrings(existing.CFiles, incoming.CFiles)
+	existing.CgoFiles = unionStrings(existing.CgoFiles, incoming.CgoFiles)
+	existing.EmbedFiles = unionStrings(existing.EmbedFiles, incoming.EmbedFiles)
+	existing.OtherFiles = unionStrings(existing.OtherFiles, incoming.OtherFiles)
+
+	if existing.Imports == nil {
+		existing.Imports = map[string]string{}
+	}
+	for k, v := range incoming.Imports {
+		prev, conflict := existing.Imports[k]
+		if !conflict || prev == v {
+			existing.Imports[k] = v
+			continue
 		}
+
+		preferred := prev
+		if isStdlibID(prev) && !isStdlibID(v) {
+			preferred = v
+		}
+		log.WithField("import", k).
+			WithField("pkgPath", existing.PkgPath).
+			Warnf("import resolves to both %s and %s, preferring %s", prev, v, preferred)
+		existing.Imports[k] = preferred
 	}
-	return false
+
+	incoming.ID = fmt.Sprintf("%s#%s", existing.PkgPath, variantTag(incoming))
+	existing.Variants = append(existing.Variants, incoming)
+	return incoming
 }
 
 // Update merges the contents of 2 packages together in the instance where they have the same package path.
 // This can happen when the gopackages aspect traverses to a child label and generates separate json files transitive targets.
 // For example, in //proto/prysm/v1alpha1 we see both `:go_default_library` and `:go_proto` from `//proto/engine/v1`.
-// Without the merge, `:go_proto` can overwrite `:go_default_library`, leaving sources files out of the final graph.
+// Rather than letting one silently overwrite the other and drop sources, both are merged into a single canonical
+// package under pkg.PkgPath, and the package that was merged in stays addressable under a synthetic variant ID
+// (see merge and FlatPackage.Variants). The first package registered for a given PkgPath goes through Add so it's
+// canonicalized and indexed into importedBy/stdlib the same way; every import gained by the merge, on either side,
+// is added to importedBy so walkUp keeps seeing this package as an importer.
 func (pr *PackageRegistry) Update(pkg *FlatPackage) {
 	existing, ok := pr.packages[pkg.PkgPath]
 	if !ok {
-		pr.packages[pkg.PkgPath] = pkg
+		pr.Add(pkg)
 		return
 	}
-	if isSuperset(pkg.GoFiles, existing.GoFiles) {
-		existing.GoFiles = pkg.GoFiles
+
+	hadImport := make(map[string]struct{}, len(existing.Imports))
+	for _, id := range existing.Imports {
+		hadImport[id] = struct{}{}
+	}
+
+	variant := merge(existing, pkg)
+	pr.packages[variant.ID] = variant
+
+	for _, id := range existing.Imports {
+		if _, ok := hadImport[id]; ok {
+			continue
+		}
+		pr.importedBy[id] = append(pr.importedBy[id], existing.ID)
+	}
+	for _, id := range variant.Imports {
+		pr.importedBy[id] = append(pr.importedBy[id], variant.ID)
 	}
 }
 
@@ -93,14 +194,23 @@ func (pr *PackageRegistry) Add(pkgs ...*FlatPackage) *PackageRegistry {
 		if pkg.IsStdlib() {
 			pr.stdlib[pkg.PkgPath] = pkg.ID
 		}
+
+		for _, importID := range pkg.Imports {
+			pr.importedBy[importID] = append(pr.importedBy[importID], pkg.ID)
+		}
 	}
 	return pr
 }
 
+// ResolvePaths resolves every package's file paths to their absolute form.
+// It no longer filters files by build tags in place: doing so mutated the
+// canonical package for whichever build context resolved first, which
+// prevented a single driver process from serving editor windows targeting
+// different platforms without a restart. Use View to obtain a build-context
+// filtered snapshot instead.
 func (pr *PackageRegistry) ResolvePaths(prf PathResolverFunc) error {
 	for _, pkg := range pr.packages {
 		pkg.ResolvePaths(prf)
-		pkg.FilterFilesForBuildTags()
 	}
 	return nil
 }
@@ -146,23 +256,137 @@ func (pr *PackageRegistry) walk(acc map[string]*FlatPackage, root string) {
 	}
 }
 
+// walkUp adds, up to depth levels, the packages that transitively import
+// root to acc. This lets gopls answer cross-package "find references"
+// queries without loading the entire workspace, similar to what `go list
+// -deps` does in reverse.
+func (pr *PackageRegistry) walkUp(acc map[string]*FlatPackage, root string, depth int) {
+	if depth <= 0 {
+		return
+	}
+	for _, importerID := range pr.importedBy[root] {
+		if _, ok := acc[importerID]; ok {
+			continue
+		}
+		importer := pr.packages[importerID]
+		if importer == nil {
+			continue
+		}
+		acc[importerID] = importer
+		pr.walkUp(acc, importerID, depth-1)
+	}
+}
+
+// needsReverseDeps reports whether req is the standard gopls "workspace
+// symbols" / "find references" case: it hasn't asked for the full
+// dependency graph but does want tests, which is when gopls otherwise has
+// no way to learn which packages reference the roots.
+func needsReverseDeps(req *DriverRequest) bool {
+	return req != nil && req.Mode&packages.NeedDeps == 0 && req.Tests
+}
+
 func (pr *PackageRegistry) Query(req *DriverRequest, queries []string) ([]string, []*FlatPackage) {
 	walkedPackages := map[string]*FlatPackage{}
 	retRoots := make([]string, 0, len(queries))
 	for _, rootPkg := range queries {
 		retRoots = append(retRoots, rootPkg)
 		pr.walk(walkedPackages, rootPkg)
+		if needsReverseDeps(req) {
+			pr.walkUp(walkedPackages, rootPkg, pr.ReverseDepDepth)
+		}
 	}
 
 	retPkgs := make([]*FlatPackage, 0, len(walkedPackages))
 	for _, pkg := range walkedPackages {
 		retPkgs = append(retPkgs, pkg)
 	}
+	applyOverlay(req, retPkgs)
 
 	return retRoots, retPkgs
 }
 
-func (pr *PackageRegistry) Match(labels []string) ([]string, []*FlatPackage) {
+// applyOverlay attaches the contents of req.Overlay (a map of file path to
+// file contents) to any package whose GoFiles or CompiledGoFiles intersect
+// the overlay, so that callers such as gopls or golangci-lint see unsaved
+// editor buffers instead of the files on disk.
+func applyOverlay(req *DriverRequest, pkgs []*FlatPackage) {
+	if req == nil || len(req.Overlay) == 0 {
+		return
+	}
+	for _, pkg := range pkgs {
+		var overlay map[string][]byte
+		for _, f := range pkg.GoFiles {
+			if contents, ok := req.Overlay[f]; ok {
+				if overlay == nil {
+					overlay = map[string][]byte{}
+				}
+				overlay[f] = contents
+			}
+		}
+		for _, f := range pkg.CompiledGoFiles {
+			if contents, ok := req.Overlay[f]; ok {
+				if overlay == nil {
+					overlay = map[string][]byte{}
+				}
+				overlay[f] = contents
+			}
+		}
+		if overlay != nil {
+			pkg.Overlay = overlay
+		}
+	}
+}
+
+// isWildcardPattern reports whether pattern is a golangci-lint-style
+// recursive pattern such as "./..." or "example.com/foo/...".
+func isWildcardPattern(pattern string) bool {
+	return pattern == "./..." || strings.HasSuffix(pattern, "/...")
+}
+
+// Resolve serves packages.Driver requests that pass bare import-path
+// patterns rather than `file=` queries, as golangci-lint does. It expands
+// "./..." and "<prefix>/..." patterns against known PkgPaths, resolves
+// plain import paths directly to their package IDs, and returns the
+// transitive import closure using the same downward walk as Match. Unlike
+// Query and Match, it never adds reverse dependencies, whatever req asks.
+// Like Query and Match, it honors req.Overlay so linters relying on this
+// path also see unsaved editor buffers.
+func (pr *PackageRegistry) Resolve(req *DriverRequest, patterns []string) ([]string, []*FlatPackage) {
+	roots := map[string]struct{}{}
+
+	for _, pattern := range patterns {
+		if !isWildcardPattern(pattern) {
+			if pkg, ok := pr.packages[pattern]; ok {
+				roots[pkg.ID] = struct{}{}
+			}
+			continue
+		}
+
+		prefix := strings.TrimSuffix(pattern, "...")
+		for _, pkg := range pr.packages {
+			if prefix == "./" || strings.HasPrefix(pkg.PkgPath+"/", prefix) {
+				roots[pkg.ID] = struct{}{}
+			}
+		}
+	}
+
+	walkedPackages := map[string]*FlatPackage{}
+	retRoots := make([]string, 0, len(roots))
+	for rootPkg := range roots {
+		retRoots = append(retRoots, rootPkg)
+		pr.walk(walkedPackages, rootPkg)
+	}
+
+	retPkgs := make([]*FlatPackage, 0, len(walkedPackages))
+	for _, pkg := range walkedPackages {
+		retPkgs = append(retPkgs, pkg)
+	}
+	applyOverlay(req, retPkgs)
+
+	return retRoots, retPkgs
+}
+
+func (pr *PackageRegistry) Match(req *DriverRequest, labels []string) ([]string, []*FlatPackage) {
 	roots := map[string]struct{}{}
 
 	for _, label := range labels {
@@ -194,12 +418,16 @@ func (pr *PackageRegistry) Match(labels []string) ([]string, []*FlatPackage) {
 	for rootPkg := range roots {
 		retRoots = append(retRoots, rootPkg)
 		pr.walk(walkedPackages, rootPkg)
+		if needsReverseDeps(req) {
+			pr.walkUp(walkedPackages, rootPkg, pr.ReverseDepDepth)
+		}
 	}
 
 	retPkgs := make([]*FlatPackage, 0, len(walkedPackages))
 	for _, pkg := range walkedPackages {
 		retPkgs = append(retPkgs, pkg)
 	}
+	applyOverlay(req, retPkgs)
 
 	return retRoots, retPkgs
 }
@@ -0,0 +1,161 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PackageView is a filtered snapshot of a PackageRegistry for a single
+// build context, e.g. {"GOOS": "darwin", "GOARCH": "arm64", "tags":
+// "integration"} parsed from DriverRequest.BuildFlags. Its packages are
+// clones of the registry's, trimmed to the files that apply under that
+// context; the underlying PackageRegistry is never mutated, so a single
+// long-lived driver process can hold a view per editor window, each
+// targeting a different platform, without restarting.
+type PackageView struct {
+	pr       *PackageRegistry
+	packages map[string]*FlatPackage
+}
+
+// View returns a PackageView of pr filtered to the build context described
+// by env. Filtering happens once, eagerly, when the view is created; pr
+// itself is left untouched, so a stale view can simply be discarded and
+// recomputed whenever BuildFlags change.
+func (pr *PackageRegistry) View(env map[string]string) *PackageView {
+	pv := &PackageView{
+		pr:       pr,
+		packages: make(map[string]*FlatPackage, len(pr.packages)),
+	}
+	for pkgPath, pkg := range pr.packages {
+		clone := clonePackage(pkg)
+		clone.FilterFilesForBuildTags(env)
+		pv.packages[pkgPath] = clone
+	}
+	return pv
+}
+
+// clonePackage makes a shallow copy of pkg with its own backing arrays for
+// the file-list fields, so that filtering one PackageView's copy can never
+// affect another view or the canonical registry.
+func clonePackage(pkg *FlatPackage) *FlatPackage {
+	clone := *pkg
+	clone.GoFiles = append([]string(nil), pkg.GoFiles...)
+	clone.CompiledGoFiles = append([]string(nil), pkg.CompiledGoFiles...)
+	clone.CFiles = append([]string(nil), pkg.CFiles...)
+	clone.CgoFiles = append([]string(nil), pkg.CgoFiles...)
+	clone.EmbedFiles = append([]string(nil), pkg.EmbedFiles...)
+	clone.OtherFiles = append([]string(nil), pkg.OtherFiles...)
+	return &clone
+}
+
+func (pv *PackageView) walk(acc map[string]*FlatPackage, root string) {
+	pkg := pv.packages[root]
+	if pkg == nil {
+		log.WithField("root", root).Error("package ID not found in view")
+		return
+	}
+
+	acc[pkg.ID] = pkg
+	for _, pkgID := range pkg.Imports {
+		if _, ok := acc[pkgID]; !ok {
+			pv.walk(acc, pkgID)
+		}
+	}
+}
+
+func (pv *PackageView) walkUp(acc map[string]*FlatPackage, root string, depth int) {
+	if depth <= 0 {
+		return
+	}
+	for _, importerID := range pv.pr.importedBy[root] {
+		if _, ok := acc[importerID]; ok {
+			continue
+		}
+		importer := pv.packages[importerID]
+		if importer == nil {
+			continue
+		}
+		acc[importerID] = importer
+		pv.walkUp(acc, importerID, depth-1)
+	}
+}
+
+// Query mirrors PackageRegistry.Query but resolves against this view's
+// filtered packages, so files excluded by the view's build context never
+// reach the caller.
+func (pv *PackageView) Query(req *DriverRequest, queries []string) ([]string, []*FlatPackage) {
+	walkedPackages := map[string]*FlatPackage{}
+	retRoots := make([]string, 0, len(queries))
+	for _, rootPkg := range queries {
+		retRoots = append(retRoots, rootPkg)
+		pv.walk(walkedPackages, rootPkg)
+		if needsReverseDeps(req) {
+			pv.walkUp(walkedPackages, rootPkg, pv.pr.ReverseDepDepth)
+		}
+	}
+
+	retPkgs := make([]*FlatPackage, 0, len(walkedPackages))
+	for _, pkg := range walkedPackages {
+		retPkgs = append(retPkgs, pkg)
+	}
+	applyOverlay(req, retPkgs)
+
+	return retRoots, retPkgs
+}
+
+// Match mirrors PackageRegistry.Match but resolves against this view's
+// filtered packages.
+func (pv *PackageView) Match(req *DriverRequest, labels []string) ([]string, []*FlatPackage) {
+	roots := map[string]struct{}{}
+
+	for _, label := range labels {
+		if !strings.HasPrefix(label, "@") {
+			label = fmt.Sprintf("@%s", label)
+		}
+
+		if label == RulesGoStdlibLabel {
+			for _, pkg := range pv.packages {
+				if pkg.Standard {
+					roots[pkg.ID] = struct{}{}
+				}
+			}
+		} else {
+			roots[label] = struct{}{}
+			if _, ok := pv.packages[label+"_xtest"]; ok {
+				roots[label+"_xtest"] = struct{}{}
+			}
+		}
+	}
+
+	walkedPackages := map[string]*FlatPackage{}
+	retRoots := make([]string, 0, len(roots))
+	for rootPkg := range roots {
+		retRoots = append(retRoots, rootPkg)
+		pv.walk(walkedPackages, rootPkg)
+		if needsReverseDeps(req) {
+			pv.walkUp(walkedPackages, rootPkg, pv.pr.ReverseDepDepth)
+		}
+	}
+
+	retPkgs := make([]*FlatPackage, 0, len(walkedPackages))
+	for _, pkg := range walkedPackages {
+		retPkgs = append(retPkgs, pkg)
+	}
+	applyOverlay(req, retPkgs)
+
+	return retRoots, retPkgs
+}
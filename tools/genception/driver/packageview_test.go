@@ -0,0 +1,63 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestViewSeesPackagesAfterResolvePipeline(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	linuxOnly := write("thing_linux.go", "package p\n\nimport \"fmt\"\n\nvar _ = fmt.Sprintf\n")
+	darwinOnly := write("thing_darwin.go", "package p\n")
+
+	pkg := &FlatPackage{
+		ID:      "//a:go_default_library",
+		PkgPath: "a",
+		GoFiles: []string{linuxOnly, darwinOnly},
+		Imports: map[string]string{},
+	}
+	pr := NewPackageRegistry(pkg)
+
+	if err := pr.ResolveImports(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pr.ResolvePaths(func(p string) string { return p }); err != nil {
+		t.Fatal(err)
+	}
+	if pkg.Imports["fmt"] != "" {
+		t.Errorf("Imports = %v, want fmt left unresolved without a stdlib entry", pkg.Imports)
+	}
+
+	pv := pr.View(map[string]string{"GOOS": "linux", "GOARCH": "amd64"})
+	_, pkgs := pv.Query(nil, []string{pkg.ID})
+	if len(pkgs) != 1 || len(pkgs[0].GoFiles) != 1 || pkgs[0].GoFiles[0] != linuxOnly {
+		t.Errorf("View(linux).Query GoFiles = %v, want only %s", pkgs, linuxOnly)
+	}
+
+	// The canonical registry must be untouched by the view's filtering.
+	if len(pkg.GoFiles) != 2 {
+		t.Errorf("canonical pkg.GoFiles = %v, want both files still present", pkg.GoFiles)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func newTestPackage(pkgPath string) *FlatPackage {
+	return &FlatPackage{
+		ID:      pkgPath,
+		PkgPath: pkgPath,
+		Imports: map[string]string{},
+	}
+}
+
+func TestResolveWildcardPrefix(t *testing.T) {
+	pr := NewPackageRegistry(
+		newTestPackage("example.com/foo"),
+		newTestPackage("example.com/foo/bar"),
+		newTestPackage("example.com/foobar"),
+		newTestPackage("example.com/other"),
+	)
+
+	roots, _ := pr.Resolve(nil, []string{"example.com/foo/..."})
+	sort.Strings(roots)
+	want := []string{"example.com/foo", "example.com/foo/bar"}
+	if !reflect.DeepEqual(roots, want) {
+		t.Errorf("Resolve(example.com/foo/...) roots = %v, want %v (sibling example.com/foobar must not match)", roots, want)
+	}
+}
+
+func TestResolveDotDotDotMatchesEverything(t *testing.T) {
+	pr := NewPackageRegistry(
+		newTestPackage("example.com/foo"),
+		newTestPackage("example.com/bar"),
+	)
+
+	roots, _ := pr.Resolve(nil, []string{"./..."})
+	sort.Strings(roots)
+	want := []string{"example.com/bar", "example.com/foo"}
+	if !reflect.DeepEqual(roots, want) {
+		t.Errorf("Resolve(./...) roots = %v, want %v", roots, want)
+	}
+}
+
+func TestResolvePlainImportPath(t *testing.T) {
+	pr := NewPackageRegistry(newTestPackage("example.com/foo"))
+
+	roots, _ := pr.Resolve(nil, []string{"example.com/foo"})
+	if !reflect.DeepEqual(roots, []string{"example.com/foo"}) {
+		t.Errorf("Resolve(example.com/foo) roots = %v, want [example.com/foo]", roots)
+	}
+
+	roots, _ = pr.Resolve(nil, []string{"example.com/nonexistent"})
+	if len(roots) != 0 {
+		t.Errorf("Resolve(example.com/nonexistent) roots = %v, want none", roots)
+	}
+}
+
+func TestResolveAppliesOverlay(t *testing.T) {
+	pkg := newTestPackage("example.com/foo")
+	pkg.GoFiles = []string{"foo.go"}
+	pr := NewPackageRegistry(pkg)
+
+	req := &DriverRequest{Overlay: map[string][]byte{"foo.go": []byte("package foo")}}
+	_, pkgs := pr.Resolve(req, []string{"example.com/foo"})
+
+	if len(pkgs) != 1 || pkgs[0].Overlay == nil || string(pkgs[0].Overlay["foo.go"]) != "package foo" {
+		t.Errorf("Resolve did not apply overlay: %+v", pkgs)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import "testing"
+
+func TestUpdateKeepsImportedByCurrent(t *testing.T) {
+	existing := newImportingPackage("proto/engine/v1", "fmt")
+	pr := NewPackageRegistry(existing)
+
+	incoming := newImportingPackage("proto/engine/v1", "context")
+	incoming.ID = "//proto/engine/v1:go_proto"
+	pr.Update(incoming)
+
+	variant := pr.packages["proto/engine/v1#proto"]
+	if variant == nil {
+		t.Fatal("variant not registered under its synthetic ID")
+	}
+
+	acc := map[string]*FlatPackage{}
+	pr.walkUp(acc, "fmt", 1)
+	if _, ok := acc[existing.ID]; !ok {
+		t.Errorf("walkUp(fmt) = %v, want existing package as importer", acc)
+	}
+
+	acc = map[string]*FlatPackage{}
+	pr.walkUp(acc, "context", 1)
+	if _, ok := acc[existing.ID]; !ok {
+		t.Errorf("walkUp(context) = %v, want merged package as importer of its newly-acquired import", acc)
+	}
+}
+
+func TestUpdateFirstRegistrationIsIndexed(t *testing.T) {
+	pr := NewPackageRegistry()
+	pkg := newImportingPackage("proto/engine/v1", "fmt")
+	pr.Update(pkg)
+
+	if pkg.ID != pkg.PkgPath {
+		t.Errorf("pkg.ID = %q, want canonicalized to PkgPath %q", pkg.ID, pkg.PkgPath)
+	}
+
+	acc := map[string]*FlatPackage{}
+	pr.walkUp(acc, "fmt", 1)
+	if _, ok := acc[pkg.ID]; !ok {
+		t.Errorf("walkUp(fmt) = %v, want first-time Update'd package as importer", acc)
+	}
+}
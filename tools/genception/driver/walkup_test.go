@@ -0,0 +1,89 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"sort"
+	"testing"
+
+	"golang.org/x/tools/go/packages"
+)
+
+func newImportingPackage(pkgPath string, imports ...string) *FlatPackage {
+	pkg := newTestPackage(pkgPath)
+	for _, imp := range imports {
+		pkg.Imports[imp] = imp
+	}
+	return pkg
+}
+
+func TestWalkUpDepthBound(t *testing.T) {
+	// chain: d -> c -> b -> a (d imports c, c imports b, b imports a)
+	pr := NewPackageRegistry(
+		newImportingPackage("a"),
+		newImportingPackage("b", "a"),
+		newImportingPackage("c", "b"),
+		newImportingPackage("d", "c"),
+	)
+
+	cases := []struct {
+		depth int
+		want  []string
+	}{
+		{0, nil},
+		{1, []string{"b"}},
+		{2, []string{"b", "c"}},
+		{3, []string{"b", "c", "d"}},
+		{10, []string{"b", "c", "d"}},
+	}
+
+	for _, c := range cases {
+		acc := map[string]*FlatPackage{}
+		pr.walkUp(acc, "a", c.depth)
+		var got []string
+		for id := range acc {
+			got = append(got, id)
+		}
+		sort.Strings(got)
+		if len(got) != len(c.want) {
+			t.Errorf("walkUp(a, depth=%d) = %v, want %v", c.depth, got, c.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("walkUp(a, depth=%d) = %v, want %v", c.depth, got, c.want)
+				break
+			}
+		}
+	}
+}
+
+func TestNeedsReverseDeps(t *testing.T) {
+	cases := []struct {
+		name string
+		req  *DriverRequest
+		want bool
+	}{
+		{"nil request", nil, false},
+		{"deps requested, tests true", &DriverRequest{Mode: packages.NeedDeps, Tests: true}, false},
+		{"no deps, no tests", &DriverRequest{Tests: false}, false},
+		{"no deps, tests true", &DriverRequest{Tests: true}, true},
+	}
+	for _, c := range cases {
+		if got := needsReverseDeps(c.req); got != c.want {
+			t.Errorf("%s: needsReverseDeps() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}